@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/thesealion/wallet"
 
@@ -20,7 +21,9 @@ import (
 
 func main() {
 	var (
-		httpAddr = flag.String("http.addr", ":8080", "HTTP listen address")
+		httpAddr     = flag.String("http.addr", ":8080", "HTTP listen address")
+		ratesAddr    = flag.String("rates.addr", "", "exchange rate service URL (static rates are used if empty)")
+		txMaxRetries = flag.Int("tx.maxRetries", 0, "max attempts, the first included, for a ledger transaction aborted by a serialization failure or deadlock (0 uses the default)")
 	)
 	flag.Parse()
 
@@ -48,10 +51,28 @@ func main() {
 	}
 	defer dbpool.Close()
 
-	// Create WalletService with db connection pool and logging.
-	var s wallet.WalletService
+	var rateProvider wallet.RateProvider
+	if *ratesAddr != "" {
+		rateProvider = wallet.NewHTTPRateProvider(*ratesAddr, nil)
+	} else {
+		rateProvider = wallet.NewStaticRateProvider(nil)
+	}
+	quoteSigningKey := []byte(os.Getenv("QUOTE_SIGNING_KEY"))
+	if len(quoteSigningKey) == 0 {
+		fmt.Fprintln(os.Stderr, "QUOTE_SIGNING_KEY must be set to a non-empty value")
+		os.Exit(1)
+	}
+
+	rules := wallet.NewRuleEngine(dbpool)
+	if err := rules.Load(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load payment rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Create Service with db connection pool and logging.
+	var s wallet.Service
 	{
-		s = wallet.NewWalletService(dbpool)
+		s = wallet.NewWalletService(dbpool, rateProvider, quoteSigningKey, rules, *txMaxRetries)
 		s = wallet.LoggingMiddleware(logger)(s)
 	}
 
@@ -60,6 +81,11 @@ func main() {
 		h = wallet.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"))
 	}
 
+	// Keep the cached account balances used by ListAccounts in sync with the postings ledger.
+	aggregatorCtx, stopAggregator := context.WithCancel(context.Background())
+	defer stopAggregator()
+	go wallet.NewBalanceAggregator(dbpool, 5*time.Second).Run(aggregatorCtx, log.With(logger, "component", "BalanceAggregator"))
+
 	errs := make(chan error)
 	go func() {
 		c := make(chan os.Signal)
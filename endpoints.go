@@ -2,12 +2,13 @@ package wallet
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/shopspring/decimal"
 )
 
-func makeListAccountsEndpoint(svc WalletService) endpoint.Endpoint {
+func makeListAccountsEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		_ = request.(listAccountsRequest)
 		accounts, err := svc.ListAccounts(ctx)
@@ -15,33 +16,43 @@ func makeListAccountsEndpoint(svc WalletService) endpoint.Endpoint {
 	}
 }
 
-func makeListPaymentsEndpoint(svc WalletService) endpoint.Endpoint {
+func makeListPaymentsEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		_ = request.(listPaymentsRequest)
 		payments, err := svc.ListPayments(ctx)
 		items := make([]*paymentItem, 0, len(payments)*2)
 		for _, payment := range payments {
 			items = append(items, &paymentItem{
-				Account:   payment.FromAccountID,
-				Amount:    payment.Amount,
-				ToAccount: payment.ToAccountID,
-				Direction: "outgoing",
+				Account:      payment.FromAccountID,
+				Amount:       payment.Amount,
+				ToAccount:    payment.ToAccountID,
+				Direction:    "outgoing",
+				SourceAmount: payment.SourceAmount,
+				DestAmount:   payment.DestAmount,
+				Rate:         payment.Rate,
+				QuoteID:      payment.QuoteID,
+				ReversesID:   payment.ReversesID,
 			})
 			items = append(items, &paymentItem{
-				Account:     payment.ToAccountID,
-				Amount:      payment.Amount,
-				FromAccount: payment.FromAccountID,
-				Direction:   "incoming",
+				Account:      payment.ToAccountID,
+				Amount:       payment.Amount,
+				FromAccount:  payment.FromAccountID,
+				Direction:    "incoming",
+				SourceAmount: payment.SourceAmount,
+				DestAmount:   payment.DestAmount,
+				Rate:         payment.Rate,
+				QuoteID:      payment.QuoteID,
+				ReversesID:   payment.ReversesID,
 			})
 		}
 		return listPaymentsResponse{Payments: items, Err: err}, nil
 	}
 }
 
-func makeSendPaymentEndpoint(svc WalletService) endpoint.Endpoint {
+func makeSendPaymentEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(sendPaymentRequest)
-		err := svc.SendPayment(ctx, req.FromAccountID, req.ToAccountID, req.Amount)
+		err := svc.SendPayment(ctx, req.FromAccountID, req.ToAccountID, req.Amount, req.QuoteToken, req.IdempotencyKey)
 		status := "Payment successfully sent"
 		if err != nil {
 			status = "Payment failed"
@@ -50,6 +61,50 @@ func makeSendPaymentEndpoint(svc WalletService) endpoint.Endpoint {
 	}
 }
 
+func makeReversePaymentEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(reversePaymentRequest)
+		payment, err := svc.ReversePayment(ctx, req.PaymentID, req.Reason)
+		resp := reversePaymentResponse{Err: err}
+		if payment != nil {
+			resp.Payment = &paymentItem{
+				Account:      payment.FromAccountID,
+				Amount:       payment.Amount,
+				ToAccount:    payment.ToAccountID,
+				Direction:    "outgoing",
+				SourceAmount: payment.SourceAmount,
+				DestAmount:   payment.DestAmount,
+				Rate:         payment.Rate,
+				QuoteID:      payment.QuoteID,
+				ReversesID:   payment.ReversesID,
+			}
+		}
+		return resp, nil
+	}
+}
+
+func makeReloadRulesEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		_ = request.(reloadRulesRequest)
+		err := svc.ReloadRules(ctx)
+		return reloadRulesResponse{Err: err}, nil
+	}
+}
+
+func makeGetQuoteEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getQuoteRequest)
+		quote, err := svc.GetQuote(ctx, req.From, req.To, req.Amount)
+		resp := getQuoteResponse{Err: err}
+		if quote != nil {
+			resp.Token = quote.Token()
+			resp.Rate = quote.Rate
+			resp.Expiry = quote.Expiry
+		}
+		return resp, nil
+	}
+}
+
 type listAccountsRequest struct{}
 
 type listAccountsResponse struct {
@@ -67,6 +122,12 @@ type paymentItem struct {
 	FromAccount string          `json:"from_account,omitempty"`
 	ToAccount   string          `json:"to_account,omitempty"`
 	Direction   string          `json:"direction"`
+
+	SourceAmount decimal.Decimal `json:"source_amount"`
+	DestAmount   decimal.Decimal `json:"dest_amount"`
+	Rate         decimal.Decimal `json:"rate,omitempty"`
+	QuoteID      string          `json:"quote_id,omitempty"`
+	ReversesID   *int            `json:"reverses_payment_id,omitempty"`
 }
 
 type listPaymentsResponse struct {
@@ -77,9 +138,11 @@ type listPaymentsResponse struct {
 func (r listPaymentsResponse) error() error { return r.Err }
 
 type sendPaymentRequest struct {
-	FromAccountID string
-	ToAccountID   string
-	Amount        decimal.Decimal
+	FromAccountID  string
+	ToAccountID    string
+	Amount         decimal.Decimal
+	QuoteToken     string
+	IdempotencyKey string `json:"-"`
 }
 
 type sendPaymentResponse struct {
@@ -88,3 +151,38 @@ type sendPaymentResponse struct {
 }
 
 func (r sendPaymentResponse) error() error { return r.Err }
+
+type reversePaymentRequest struct {
+	PaymentID int
+	Reason    string
+}
+
+type reversePaymentResponse struct {
+	Payment *paymentItem `json:"payment,omitempty"`
+	Err     error        `json:"err,omitempty"`
+}
+
+func (r reversePaymentResponse) error() error { return r.Err }
+
+type reloadRulesRequest struct{}
+
+type reloadRulesResponse struct {
+	Err error `json:"err,omitempty"`
+}
+
+func (r reloadRulesResponse) error() error { return r.Err }
+
+type getQuoteRequest struct {
+	From   string
+	To     string
+	Amount decimal.Decimal
+}
+
+type getQuoteResponse struct {
+	Token  string          `json:"token,omitempty"`
+	Rate   decimal.Decimal `json:"rate,omitempty"`
+	Expiry time.Time       `json:"expiry,omitempty"`
+	Err    error           `json:"err,omitempty"`
+}
+
+func (r getQuoteResponse) error() error { return r.Err }
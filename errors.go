@@ -0,0 +1,22 @@
+package wallet
+
+// Error wraps one of the package's sentinel errors with contextual details
+// (e.g. the accounts and amounts involved) to be surfaced to API clients
+// alongside the error's machine code. It unwraps to the sentinel error, so
+// errors.Is/errors.As still match it.
+type Error struct {
+	Err     error
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// withDetails wraps err with details, unless err is nil.
+func withDetails(err error, details map[string]interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err, Details: details}
+}
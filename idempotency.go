@@ -0,0 +1,170 @@
+package wallet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrIdempotencyKeyReuse indicates that an idempotency key was reused with a different request.
+	ErrIdempotencyKeyReuse = errors.New("idempotency key already used with a different request")
+
+	// ErrIdempotencyInProgress indicates that a request with this idempotency key is still being processed.
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is already in progress")
+
+	// ErrIdempotencyIndeterminate indicates that a previous request with
+	// this idempotency key claimed the key but never recorded an outcome
+	// (e.g. the process crashed or lost its database connection between
+	// sending the payment and writing back the result), so whether it
+	// actually sent the payment is unknown. It is not safe to retry
+	// automatically; an operator must reconcile it by hand (e.g. by
+	// checking ListPayments for a matching transfer) before the key can be
+	// reused.
+	ErrIdempotencyIndeterminate = errors.New("a previous request with this idempotency key never recorded its outcome and must be reconciled manually")
+)
+
+// pgUniqueViolation is the SQLSTATE Postgres reports for a violated unique constraint.
+const pgUniqueViolation = "23505"
+
+// idempotencyPendingTimeout bounds how long a 'pending' claim is assumed to
+// still be in flight. A pending row older than this is past any realistic
+// request duration, so the original request likely crashed after sending
+// the payment but before recordIdempotencyResult could mark it done.
+const idempotencyPendingTimeout = 30 * time.Second
+
+// SendPayment sends a payment, honoring idempotencyKey so that retried
+// requests (matching PSP convention) are not applied twice: a second call
+// with the same key and the same request parameters replays the first
+// call's result instead of sending the payment again.
+func (s *service) SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal, quoteToken, idempotencyKey string) error {
+	if idempotencyKey == "" {
+		return s.sendPayment(ctx, fromAccountID, toAccountID, amount, quoteToken)
+	}
+
+	requestHash := hashRequest(fromAccountID, toAccountID, amount, quoteToken)
+	claimed, cachedErr, err := s.claimIdempotencyKey(ctx, idempotencyKey, requestHash)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return cachedErr
+	}
+
+	err = s.sendPayment(ctx, fromAccountID, toAccountID, amount, quoteToken)
+	if recordErr := s.recordIdempotencyResult(ctx, idempotencyKey, err); recordErr != nil {
+		if err == nil {
+			// The payment was sent, but we failed to record that fact: say
+			// so plainly rather than returning a bare DB error that would
+			// look like the send itself failed. The key is stuck 'pending'
+			// until an operator reconciles it (see ErrIdempotencyIndeterminate).
+			return fmt.Errorf("payment sent successfully but failed to record idempotency result for key %q, which is now stuck pending reconciliation: %w", idempotencyKey, recordErr)
+		}
+		return recordErr
+	}
+	return err
+}
+
+// claimIdempotencyKey tries to reserve key for a new request. If it is
+// already claimed, claimed is false and cachedErr is the outcome to replay
+// (or ErrIdempotencyKeyReuse / ErrIdempotencyInProgress /
+// ErrIdempotencyIndeterminate).
+func (s *service) claimIdempotencyKey(ctx context.Context, key, requestHash string) (claimed bool, cachedErr error, err error) {
+	_, err = s.db.Exec(ctx, "INSERT INTO idempotency (key, request_hash, status) VALUES ($1, $2, 'pending')", key, requestHash)
+	if err == nil {
+		return true, nil, nil
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return false, nil, err
+	}
+
+	var (
+		existingHash string
+		status       string
+		errorMessage *string
+		errorCode    *string
+		errorDetails json.RawMessage
+		createdAt    time.Time
+	)
+	err = s.db.QueryRow(ctx, "SELECT request_hash, status, error_message, error_code, error_details, created_at FROM idempotency WHERE key = $1", key).
+		Scan(&existingHash, &status, &errorMessage, &errorCode, &errorDetails, &createdAt)
+	if err != nil {
+		return false, nil, err
+	}
+	if existingHash != requestHash {
+		return false, ErrIdempotencyKeyReuse, nil
+	}
+	if status == "pending" {
+		if time.Since(createdAt) > idempotencyPendingTimeout {
+			return false, ErrIdempotencyIndeterminate, nil
+		}
+		return false, ErrIdempotencyInProgress, nil
+	}
+	if errorMessage != nil {
+		return false, replayError(*errorMessage, errorCode, errorDetails), nil
+	}
+	return false, nil, nil
+}
+
+// replayError reconstructs the error recorded by recordIdempotencyResult,
+// preserving its sentinel (so errors.Is/errors.As still match) and details
+// when a machine code was stored; it falls back to a plain error carrying
+// just the message for rows written before error codes were tracked.
+func replayError(message string, code *string, details json.RawMessage) error {
+	if code == nil {
+		return errors.New(message)
+	}
+	sentinel := errorFromCode(*code)
+	if sentinel == nil {
+		return errors.New(message)
+	}
+	if len(details) == 0 {
+		return sentinel
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(details, &parsed); err != nil {
+		return sentinel
+	}
+	return withDetails(sentinel, parsed)
+}
+
+// recordIdempotencyResult stores the outcome of the request claimed by key, so a retry can replay it.
+func (s *service) recordIdempotencyResult(ctx context.Context, key string, result error) error {
+	var (
+		errorMessage *string
+		errorCode    *string
+		errorDetails json.RawMessage
+	)
+	if result != nil {
+		msg := result.Error()
+		errorMessage = &msg
+		code, _ := codeFrom(result)
+		errorCode = &code
+
+		var walletErr *Error
+		if errors.As(result, &walletErr) && walletErr.Details != nil {
+			b, err := json.Marshal(walletErr.Details)
+			if err != nil {
+				return err
+			}
+			errorDetails = b
+		}
+	}
+	_, err := s.db.Exec(ctx,
+		"UPDATE idempotency SET status = 'done', error_message = $1, error_code = $2, error_details = $3 WHERE key = $4",
+		errorMessage, errorCode, errorDetails, key)
+	return err
+}
+
+func hashRequest(fromAccountID, toAccountID string, amount decimal.Decimal, quoteToken string) string {
+	h := sha256.Sum256([]byte(fromAccountID + "|" + toAccountID + "|" + amount.String() + "|" + quoteToken))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,101 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// TestHotAccountThroughput sends many small concurrent transfers into a
+// single hot destination account under both locking strategies and checks
+// that today's optimistic, retried SERIALIZABLE transactions complete the
+// same workload without deadlocking as the old pessimistic FOR UPDATE
+// locking it replaced. The relative wall-clock time between the two is
+// logged for comparison but not asserted on: a single run is too noisy
+// (shared CI runners, GC pauses, etc.) to treat as a reliable regression
+// signal, so it's informational only.
+func TestHotAccountThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping load test in -short mode")
+	}
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	ctx := context.Background()
+
+	lockingElapsed, lockingRetries := runHotAccountLoad(ctx, t, dbpool, true)
+	t.Logf("pessimistic (FOR UPDATE): %s (retries: %v)", lockingElapsed, lockingRetries)
+
+	optimisticElapsed, optimisticRetries := runHotAccountLoad(ctx, t, dbpool, false)
+	t.Logf("optimistic (retried SERIALIZABLE): %s (retries: %v)", optimisticElapsed, optimisticRetries)
+}
+
+// runHotAccountLoad drives concurrent transfers into a single hot account
+// using postTransactionTx's forUpdate parameter to select the locking
+// strategy, and returns the wall-clock time taken and retries recorded.
+func runHotAccountLoad(ctx context.Context, t *testing.T, dbpool *pgxpool.Pool, forUpdate bool) (time.Duration, map[string]int) {
+	t.Helper()
+
+	const concurrency = 20
+	const transfersPerWorker = 10
+	const transferAmount = 1
+
+	before, err := getBalance(ctx, dbpool, "alice456", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startRetries := RetryCounts()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < transfersPerWorker; j++ {
+				postings := []Posting{
+					{AccountID: "bob123", Currency: "USD", Amount: decimal.NewFromInt(-transferAmount)},
+					{AccountID: "alice456", Currency: "USD", Amount: decimal.NewFromInt(transferAmount)},
+				}
+				err := withSerializableRetry(ctx, dbpool, defaultMaxRetries, func(tx pgx.Tx) error {
+					_, err := postTransactionTx(ctx, tx, postings, forUpdate)
+					return err
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	after, err := getBalance(ctx, dbpool, "alice456", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := before.Add(decimal.NewFromInt(concurrency * transfersPerWorker * transferAmount))
+	if !after.Equal(want) {
+		t.Fatalf("balance %s, want %s: some concurrent transfers were lost", after, want)
+	}
+
+	endRetries := RetryCounts()
+	retries := make(map[string]int, len(endRetries))
+	for code, n := range endRetries {
+		retries[code] = n - startRetries[code]
+	}
+	return elapsed, retries
+}
@@ -0,0 +1,95 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrRateUnavailable indicates that no exchange rate could be obtained for the requested currency pair.
+var ErrRateUnavailable = fmt.Errorf("exchange rate unavailable")
+
+// RateProvider looks up the exchange rate to convert between two currencies.
+type RateProvider interface {
+	// GetRate returns the rate to convert one unit of "from" into "to".
+	GetRate(ctx context.Context, from, to string) (decimal.Decimal, error)
+}
+
+// StaticRateProvider serves exchange rates from a fixed, in-memory table.
+// It is mainly useful for tests and for deployments with a small, rarely
+// changing set of currency pairs.
+type StaticRateProvider struct {
+	rates map[string]decimal.Decimal
+}
+
+// NewStaticRateProvider creates a StaticRateProvider from a map keyed by
+// "FROM:TO" currency pairs, e.g. map[string]decimal.Decimal{"USD:EUR": ...}.
+func NewStaticRateProvider(rates map[string]decimal.Decimal) *StaticRateProvider {
+	return &StaticRateProvider{rates: rates}
+}
+
+// GetRate implements RateProvider.
+func (p *StaticRateProvider) GetRate(ctx context.Context, from, to string) (decimal.Decimal, error) {
+	if from == to {
+		return decimal.NewFromInt(1), nil
+	}
+	rate, ok := p.rates[from+":"+to]
+	if !ok {
+		return decimal.Decimal{}, ErrRateUnavailable
+	}
+	return rate, nil
+}
+
+// HTTPRateProvider fetches exchange rates from a remote HTTP endpoint of the
+// form "{baseURL}?from=USD&to=EUR", expecting a JSON body of {"rate": "1.23"}.
+type HTTPRateProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRateProvider creates an HTTPRateProvider querying baseURL for rates.
+func NewHTTPRateProvider(baseURL string, client *http.Client) *HTTPRateProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPRateProvider{baseURL: baseURL, client: client}
+}
+
+// GetRate implements RateProvider.
+func (p *HTTPRateProvider) GetRate(ctx context.Context, from, to string) (decimal.Decimal, error) {
+	if from == to {
+		return decimal.NewFromInt(1), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL, nil)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	q := req.URL.Query()
+	q.Set("from", from)
+	q.Set("to", to)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decimal.Decimal{}, ErrRateUnavailable
+	}
+
+	var body struct {
+		Rate decimal.Decimal `json:"rate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return decimal.Decimal{}, err
+	}
+	return body.Rate, nil
+}
+
+// quoteTTL is how long a quote stays valid after it is issued.
+const quoteTTL = 30 * time.Second
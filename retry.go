@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	// pgSerializationFailure is the SQLSTATE Postgres reports when a
+	// SERIALIZABLE transaction cannot be committed without violating
+	// serializability.
+	pgSerializationFailure = "40001"
+
+	// pgDeadlockDetected is the SQLSTATE Postgres reports when a transaction
+	// is aborted to break a deadlock.
+	pgDeadlockDetected = "40P01"
+
+	// defaultMaxRetries is used by NewWalletService when no explicit limit is given.
+	defaultMaxRetries = 5
+
+	retryBaseDelay = 10 * time.Millisecond
+	retryMaxDelay  = 400 * time.Millisecond
+)
+
+// retryCounts tracks how many times a ledger transaction has been retried,
+// keyed by the Postgres error code that triggered the retry, so operators
+// can alert on contention without needing a full metrics backend wired in.
+var retryCounts = struct {
+	mu     sync.Mutex
+	byCode map[string]int
+}{byCode: make(map[string]int)}
+
+func recordRetry(code string) {
+	retryCounts.mu.Lock()
+	retryCounts.byCode[code]++
+	retryCounts.mu.Unlock()
+}
+
+// RetryCounts returns a snapshot of the number of ledger transaction retries
+// performed so far, keyed by Postgres error code (e.g. "40001", "40P01").
+func RetryCounts() map[string]int {
+	retryCounts.mu.Lock()
+	defer retryCounts.mu.Unlock()
+	counts := make(map[string]int, len(retryCounts.byCode))
+	for code, n := range retryCounts.byCode {
+		counts[code] = n
+	}
+	return counts
+}
+
+// withSerializableRetry runs fn inside a SERIALIZABLE transaction against
+// db, committing on success. If fn or the commit fails with a serialization
+// failure or deadlock (40001/40P01), it retries with bounded exponential
+// backoff, up to maxAttempts tries in total. Any other error is returned
+// immediately without retrying.
+func withSerializableRetry(ctx context.Context, db *pgxpool.Pool, maxAttempts int, fn func(tx pgx.Tx) error) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			if werr := waitBackoff(ctx, attempt-1); werr != nil {
+				return werr
+			}
+		}
+		err = runInTx(ctx, db, fn)
+		if err == nil {
+			return nil
+		}
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || (pgErr.Code != pgSerializationFailure && pgErr.Code != pgDeadlockDetected) {
+			return err
+		}
+		if attempt < maxAttempts {
+			recordRetry(pgErr.Code)
+		}
+	}
+	return err
+}
+
+func runInTx(ctx context.Context, db *pgxpool.Pool, fn func(tx pgx.Tx) error) error {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// waitBackoff sleeps for an exponentially increasing, jittered delay before
+// retry number n (n=1 is the first retry), returning early with ctx.Err()
+// if ctx is canceled first.
+func waitBackoff(ctx context.Context, n int) error {
+	delay := retryBaseDelay << uint(n-1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2+1)))
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sortedIDs returns the account IDs touched by a multi-account operation in
+// a canonical (ascending) order, so reads are deterministic across retries.
+func sortedIDs(accountIDs map[string]struct{}) []string {
+	ids := make([]string, 0, len(accountIDs))
+	for id := range accountIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,105 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// ErrPaymentNotFound indicates that no payment exists with the given ID.
+	ErrPaymentNotFound = errors.New("payment not found")
+
+	// ErrPaymentAlreadyReversed indicates that a payment has already been reversed once.
+	ErrPaymentAlreadyReversed = errors.New("payment already reversed")
+)
+
+// ReversePayment reverses a previously sent payment by posting a
+// compensating transaction that swaps the direction of its original
+// postings, inside a single SERIALIZABLE transaction that also records the
+// reversal, retried with backoff on serialization failures or deadlocks. It
+// refuses to do so if paymentID does not exist, has already been reversed,
+// or if reversing it would leave either account's balance negative.
+func (s *service) ReversePayment(ctx context.Context, paymentID int, reason string) (*Payment, error) {
+	var reversal *Payment
+	err := withSerializableRetry(ctx, s.db, s.maxTxRetries, func(tx pgx.Tx) error {
+		r, err := reversePaymentTx(ctx, tx, paymentID, reason)
+		if err != nil {
+			return err
+		}
+		reversal = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reversal, nil
+}
+
+func reversePaymentTx(ctx context.Context, tx pgx.Tx, paymentID int, reason string) (*Payment, error) {
+	var original Payment
+	err := tx.QueryRow(ctx, `
+		SELECT id, from_account_id, to_account_id, amount, source_amount, dest_amount, rate,
+			COALESCE(quote_id, ''), COALESCE(transaction_id, '')
+		FROM payments WHERE id = $1 FOR UPDATE`, paymentID,
+	).Scan(&original.ID, &original.FromAccountID, &original.ToAccountID, &original.Amount,
+		&original.SourceAmount, &original.DestAmount, &original.Rate, &original.QuoteID, &original.TransactionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var alreadyReversed bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM payments WHERE reverses_id = $1)", paymentID).Scan(&alreadyReversed)
+	if err != nil {
+		return nil, err
+	}
+	if alreadyReversed {
+		return nil, ErrPaymentAlreadyReversed
+	}
+
+	rows, err := tx.Query(ctx, "SELECT account_id, currency, amount FROM postings WHERE transaction_id = $1", original.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	var reversePostings []Posting
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.AccountID, &p.Currency, &p.Amount); err != nil {
+			return nil, err
+		}
+		p.Amount = p.Amount.Neg()
+		reversePostings = append(reversePostings, p)
+	}
+
+	txnID, err := postTransactionTx(ctx, tx, reversePostings, false)
+	if err != nil {
+		return nil, err
+	}
+
+	reversal := &Payment{
+		FromAccountID: original.ToAccountID,
+		ToAccountID:   original.FromAccountID,
+		Amount:        original.Amount,
+		SourceAmount:  original.DestAmount,
+		DestAmount:    original.SourceAmount,
+		Rate:          original.Rate,
+		TransactionID: txnID,
+		ReversesID:    &original.ID,
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO payments (from_account_id, to_account_id, amount, source_amount, dest_amount, rate, transaction_id, reverses_id, reversal_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`,
+		reversal.FromAccountID, reversal.ToAccountID, reversal.Amount, reversal.SourceAmount, reversal.DestAmount,
+		reversal.Rate, reversal.TransactionID, reversal.ReversesID, reason,
+	).Scan(&reversal.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return reversal, nil
+}
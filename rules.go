@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/shopspring/decimal"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	// ErrRuleDenied indicates that a rule script denied the proposed transfer.
+	ErrRuleDenied = errors.New("payment denied by rule")
+
+	// ErrApprovalRequired indicates that a rule script requires the transfer to be manually approved.
+	ErrApprovalRequired = errors.New("payment requires approval")
+)
+
+// Rule is a user-defined Lua script evaluated against every proposed
+// transfer it applies to. A nil AccountID means the rule is global.
+type Rule struct {
+	ID        int
+	AccountID *string
+	Script    string
+}
+
+type ruleVerdict int
+
+const (
+	ruleAllow ruleVerdict = iota
+	ruleDeny
+	ruleRequireApproval
+)
+
+// RuleEngine evaluates Rules against proposed transfers using an embedded
+// Lua interpreter (gopher-lua), so operators can express payment policies
+// without a code change and reload them at runtime.
+type RuleEngine struct {
+	db *pgxpool.Pool
+
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// NewRuleEngine creates a RuleEngine backed by the rules table. Call Load
+// once at startup to populate its cache.
+func NewRuleEngine(db *pgxpool.Pool) *RuleEngine {
+	return &RuleEngine{db: db}
+}
+
+// Load fetches all rules from the database, atomically replacing the cached
+// set used by Check. It is called once at service start and again on every
+// hot reload via POST /rules.
+func (e *RuleEngine) Load(ctx context.Context) error {
+	rows, err := e.db.Query(ctx, "SELECT id, account_id, script FROM rules ORDER BY id")
+	if err != nil {
+		return err
+	}
+	rules := make([]Rule, 0)
+	for rows.Next() {
+		var r Rule
+		if err := rows.Scan(&r.ID, &r.AccountID, &r.Script); err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	e.mu.Lock()
+	e.rules = rules
+	e.mu.Unlock()
+	return nil
+}
+
+// Check runs every cached rule that applies to fromAccount or toAccount
+// against the proposed transfer. It returns ErrRuleDenied if any rule denies
+// the transfer, or ErrApprovalRequired if one asks for approval and none
+// denies it.
+func (e *RuleEngine) Check(fromAccount, toAccount *Account, amount decimal.Decimal) error {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	approvalRequired := false
+	for _, rule := range rules {
+		if rule.AccountID != nil && *rule.AccountID != fromAccount.ID && *rule.AccountID != toAccount.ID {
+			continue
+		}
+		verdict, reason, err := evalRule(rule.Script, fromAccount, toAccount, amount)
+		if err != nil {
+			return err
+		}
+		switch verdict {
+		case ruleDeny:
+			if reason == "" {
+				reason = "denied by rule"
+			}
+			return fmt.Errorf("%w: %s", ErrRuleDenied, reason)
+		case ruleRequireApproval:
+			approvalRequired = true
+		}
+	}
+	if approvalRequired {
+		return ErrApprovalRequired
+	}
+	return nil
+}
+
+// evalRule runs script in a fresh Lua state with read-only from_account,
+// to_account, amount and currency globals, and returns the verdict reached
+// by calling allow(), deny(reason) or require_approval().
+func evalRule(script string, fromAccount, toAccount *Account, amount decimal.Decimal) (ruleVerdict, string, error) {
+	L := lua.NewState()
+	defer L.Close()
+
+	verdict := ruleAllow
+	reason := ""
+
+	L.SetGlobal("from_account", readOnlyAccountTable(L, fromAccount))
+	L.SetGlobal("to_account", readOnlyAccountTable(L, toAccount))
+	L.SetGlobal("amount", lua.LString(amount.String()))
+	L.SetGlobal("currency", lua.LString(fromAccount.Currency))
+
+	L.SetGlobal("allow", L.NewFunction(func(L *lua.LState) int {
+		verdict = ruleAllow
+		return 0
+	}))
+	L.SetGlobal("deny", L.NewFunction(func(L *lua.LState) int {
+		verdict = ruleDeny
+		reason = L.OptString(1, "")
+		return 0
+	}))
+	L.SetGlobal("require_approval", L.NewFunction(func(L *lua.LState) int {
+		verdict = ruleRequireApproval
+		return 0
+	}))
+
+	if err := L.DoString(script); err != nil {
+		return ruleAllow, "", err
+	}
+	return verdict, reason, nil
+}
+
+// readOnlyAccountTable builds a Lua table exposing an account's public
+// fields to rule scripts, rejecting any attempt by the script to modify it.
+func readOnlyAccountTable(L *lua.LState, a *Account) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("id", lua.LString(a.ID))
+	t.RawSetString("currency", lua.LString(a.Currency))
+	t.RawSetString("balance", lua.LString(a.Balance.String()))
+	t.RawSetString("strict_currency", lua.LBool(a.StrictCurrency))
+
+	// Scripts see an empty proxy that reads through to t, so that every
+	// assignment, including to an existing field, reaches __newindex.
+	proxy := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", t)
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("account tables are read-only")
+		return 0
+	}))
+	L.SetMetatable(proxy, mt)
+	return proxy
+}
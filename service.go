@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/jackc/pgtype"
@@ -21,15 +22,49 @@ type Service interface {
 	// ListPayments list all the accounts in the system.
 	ListPayments(ctx context.Context) ([]*Payment, error)
 
-	// SendPayment transfers money between two accounts with the same currency.
-	SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal) error
+	// GetQuote returns a signed, time-limited quote for converting amount
+	// from one currency to another, to be passed to SendPayment.
+	GetQuote(ctx context.Context, from, to string, amount decimal.Decimal) (*Quote, error)
+
+	// SendPayment transfers money between two accounts. If the accounts have
+	// different currencies, quoteToken must be a valid, unexpired quote
+	// obtained from GetQuote for the same currency pair and amount.
+	// idempotencyKey, if non-empty, makes retries of the same request safe:
+	// a repeated call with the same key and request replays the first
+	// attempt's outcome instead of sending the payment again.
+	SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal, quoteToken, idempotencyKey string) error
+
+	// ReversePayment creates a compensating payment reversing paymentID,
+	// posted atomically to the ledger, and returns it.
+	ReversePayment(ctx context.Context, paymentID int, reason string) (*Payment, error)
+
+	// PostTransaction atomically appends postings (which must sum to zero per
+	// currency) to the ledger and returns the resulting transaction ID.
+	PostTransaction(ctx context.Context, postings []Posting) (string, error)
+
+	// GetBalance returns an account's balance derived from the postings
+	// ledger as of the given time, or now if at is the zero time.
+	GetBalance(ctx context.Context, accountID string, at time.Time) (decimal.Decimal, error)
+
+	// ReloadRules refreshes the in-memory rule cache used to validate
+	// payments from the rules table.
+	ReloadRules(ctx context.Context) error
 }
 
-// Account is the main entity of the wallet service.
+// Account is the main entity of the wallet service. Balance is derived from
+// the postings ledger rather than stored directly; see GetBalance.
 type Account struct {
 	ID       string          `json:"id"`
 	Balance  decimal.Decimal `json:"balance"`
 	Currency string          `json:"currency"`
+
+	// StrictCurrency, when true, makes the account refuse any payment in a
+	// currency other than its own, even if a valid quote is supplied.
+	StrictCurrency bool `json:"strict_currency"`
+
+	// AllowNegative, when true, exempts the account from the insufficient
+	// balance check, as used by system accounts such as FX suspense accounts.
+	AllowNegative bool `json:"-"`
 }
 
 // Payment is the entity representing money transfers between accounts.
@@ -38,6 +73,24 @@ type Payment struct {
 	FromAccountID string
 	ToAccountID   string
 	Amount        decimal.Decimal
+
+	// SourceAmount and DestAmount are the amounts debited from the sender
+	// and credited to the recipient, in their own currencies. They are equal
+	// to Amount for same-currency payments.
+	SourceAmount decimal.Decimal
+	DestAmount   decimal.Decimal
+
+	// Rate is the exchange rate applied, or zero for same-currency payments.
+	Rate decimal.Decimal
+
+	// QuoteID references the quote used to lock in Rate, if any.
+	QuoteID string
+
+	// TransactionID references the ledger Transaction this payment posted.
+	TransactionID string
+
+	// ReversesID is the ID of the payment this one reverses, if it is a reversal.
+	ReversesID *int
 }
 
 var (
@@ -60,16 +113,32 @@ var (
 
 	// ErrSameAccount indicates an attempt to make a payment within the same account.
 	ErrSameAccount = errors.New("cannot send a payment to the same account")
+
+	// ErrQuoteRequired indicates that a cross-currency payment was attempted without a quote token.
+	ErrQuoteRequired = errors.New("a quote is required to convert between currencies")
 )
 
 // Service implementation using Postgres for storage.
 type service struct {
-	db *pgxpool.Pool
+	db           *pgxpool.Pool
+	rateProvider RateProvider
+	quoteSigner  *quoteSigner
+	rules        *RuleEngine
+	maxTxRetries int
 }
 
-// NewWalletService creates a new service with Postgres storage.
-func NewWalletService(db *pgxpool.Pool) Service {
-	return &service{db}
+// NewWalletService creates a new service with Postgres storage. rateProvider
+// is used to price quotes, quoteSigningKey authenticates quote tokens handed
+// out by GetQuote, and rules validates proposed payments; pass in a
+// RuleEngine already Load-ed with the current rule set. maxTxRetries bounds
+// how many attempts in total, the first one included, a ledger transaction
+// gets when it is aborted by a serialization failure or deadlock before
+// giving up; if zero or negative, defaultMaxRetries is used.
+func NewWalletService(db *pgxpool.Pool, rateProvider RateProvider, quoteSigningKey []byte, rules *RuleEngine, maxTxRetries int) Service {
+	if maxTxRetries <= 0 {
+		maxTxRetries = defaultMaxRetries
+	}
+	return &service{db, rateProvider, newQuoteSigner(quoteSigningKey), rules, maxTxRetries}
 }
 
 // InitDB connects to Postgres using pgx.
@@ -91,56 +160,99 @@ func InitDB() (*pgxpool.Pool, error) {
 	return dbpool, nil
 }
 
-// Read accounts from DB into a slice
+// Read accounts (without their balance, which is derived from postings) from DB into a slice.
 func getAccounts(rows pgx.Rows) ([]*Account, error) {
 	accounts := make([]*Account, 0)
 	for rows.Next() {
 		var (
-			id       string
-			balance  decimal.Decimal
-			currency string
+			id             string
+			currency       string
+			strictCurrency bool
+			allowNegative  bool
 		)
-		err := rows.Scan(&id, &balance, &currency)
+		err := rows.Scan(&id, &currency, &strictCurrency, &allowNegative)
 		if err != nil {
 			return nil, err
 		}
-		accounts = append(accounts, &Account{id, balance, currency})
+		accounts = append(accounts, &Account{ID: id, Currency: currency, StrictCurrency: strictCurrency, AllowNegative: allowNegative})
 	}
 	return accounts, nil
 }
 
 func (s *service) ListAccounts(ctx context.Context) ([]*Account, error) {
-	rows, err := s.db.Query(ctx, "SELECT id, balance, currency FROM accounts ORDER BY id")
+	rows, err := s.db.Query(ctx, `
+		SELECT a.id, a.currency, a.strict_currency, a.allow_negative, COALESCE(b.balance, 0)
+		FROM accounts a
+		LEFT JOIN account_balances b ON b.account_id = a.id
+		ORDER BY a.id`)
 	if err != nil {
 		return nil, err
 	}
-	return getAccounts(rows)
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		var a Account
+		err := rows.Scan(&a.ID, &a.Currency, &a.StrictCurrency, &a.AllowNegative, &a.Balance)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &a)
+	}
+	return accounts, nil
 }
 
 func (s *service) ListPayments(ctx context.Context) ([]*Payment, error) {
 	payments := make([]*Payment, 0)
-	rows, err := s.db.Query(ctx, "SELECT id, from_account_id, to_account_id, amount FROM payments ORDER BY id")
+	rows, err := s.db.Query(ctx, `
+		SELECT id, from_account_id, to_account_id, amount,
+			source_amount, dest_amount, rate, COALESCE(quote_id, ''),
+			COALESCE(transaction_id, ''), reverses_id
+		FROM payments ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		var (
-			id            int
-			fromAccountID string
-			toAccountID   string
-			amount        decimal.Decimal
-		)
-		err = rows.Scan(&id, &fromAccountID, &toAccountID, &amount)
+		var p Payment
+		err = rows.Scan(&p.ID, &p.FromAccountID, &p.ToAccountID, &p.Amount,
+			&p.SourceAmount, &p.DestAmount, &p.Rate, &p.QuoteID,
+			&p.TransactionID, &p.ReversesID)
 		if err != nil {
 			return nil, err
 		}
-		payments = append(payments, &Payment{id, fromAccountID, toAccountID, amount})
+		payments = append(payments, &p)
 	}
 
 	return payments, nil
 }
 
-func (s *service) SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal) error {
+// GetQuote prices amount of the from currency in the to currency and returns
+// a signed token locking in that rate for quoteTTL.
+func (s *service) GetQuote(ctx context.Context, from, to string, amount decimal.Decimal) (*Quote, error) {
+	if !amount.IsPositive() {
+		return nil, ErrInvalidAmount
+	}
+	rate, err := s.rateProvider.GetRate(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	q := &Quote{
+		ID:     newQuoteID(),
+		From:   from,
+		To:     to,
+		Amount: amount,
+		Rate:   rate,
+		Expiry: time.Now().Add(quoteTTL),
+	}
+	token, err := s.quoteSigner.sign(q)
+	if err != nil {
+		return nil, err
+	}
+	q.token = token
+	return q, nil
+}
+
+// sendPayment is the actual payment-sending logic; SendPayment wraps it with
+// idempotency-key handling.
+func (s *service) sendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal, quoteToken string) error {
 	// Check parameters
 	if fromAccountID == "" || toAccountID == "" {
 		return ErrAccountNotSpecified
@@ -152,12 +264,7 @@ func (s *service) SendPayment(ctx context.Context, fromAccountID, toAccountID st
 		return ErrInvalidAmount
 	}
 
-	tx, err := s.db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-	rows, err := tx.Query(ctx, "SELECT id, balance, currency FROM accounts WHERE id = $1 OR id = $2 ORDER BY id FOR UPDATE", fromAccountID, toAccountID)
+	rows, err := s.db.Query(ctx, "SELECT id, currency, strict_currency, allow_negative FROM accounts WHERE id = $1 OR id = $2", fromAccountID, toAccountID)
 	if err != nil {
 		return err
 	}
@@ -173,32 +280,107 @@ func (s *service) SendPayment(ctx context.Context, fromAccountID, toAccountID st
 	toAccount := accountsByID[toAccountID]
 
 	if fromAccount == nil || toAccount == nil {
-		return ErrAccountNotFound
-	}
-	if fromAccount.Currency != toAccount.Currency {
-		return ErrCurrencyMismatch
-	}
-	fromAccount.Balance = fromAccount.Balance.Sub(amount)
-	toAccount.Balance = toAccount.Balance.Add(amount)
-	if fromAccount.Balance.IsNegative() {
-		return ErrInsufficientBalance
+		return withDetails(ErrAccountNotFound, map[string]interface{}{
+			"from_account_id": fromAccountID,
+			"to_account_id":   toAccountID,
+		})
 	}
 
-	_, err = tx.Exec(ctx, "UPDATE accounts SET balance = $1 WHERE id = $2", fromAccount.Balance, fromAccount.ID)
+	fromAccount.Balance, err = getBalance(ctx, s.db, fromAccount.ID, time.Time{})
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(ctx, "UPDATE accounts SET balance = $1 WHERE id = $2", toAccount.Balance, toAccount.ID)
+	toAccount.Balance, err = getBalance(ctx, s.db, toAccount.ID, time.Time{})
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec(ctx, "INSERT INTO payments (from_account_id, to_account_id, amount) VALUES ($1, $2, $3)", fromAccount.ID, toAccount.ID, amount)
-	if err != nil {
+
+	if err := s.rules.Check(fromAccount, toAccount, amount); err != nil {
 		return err
 	}
-	err = tx.Commit(ctx)
-	if err != nil {
+
+	sourceAmount := amount
+	destAmount := amount
+	var rate decimal.Decimal
+	var quoteID string
+	postings := make([]Posting, 0, 4)
+
+	if fromAccount.Currency == toAccount.Currency {
+		postings = append(postings,
+			Posting{AccountID: fromAccount.ID, Currency: fromAccount.Currency, Amount: amount.Neg()},
+			Posting{AccountID: toAccount.ID, Currency: toAccount.Currency, Amount: amount},
+		)
+	} else {
+		if fromAccount.StrictCurrency || toAccount.StrictCurrency {
+			return withDetails(ErrCurrencyMismatch, map[string]interface{}{
+				"from_currency": fromAccount.Currency,
+				"to_currency":   toAccount.Currency,
+			})
+		}
+		if quoteToken == "" {
+			return ErrQuoteRequired
+		}
+		quote, err := s.quoteSigner.verify(quoteToken)
+		if err != nil {
+			return err
+		}
+		if quote.From != fromAccount.Currency || quote.To != toAccount.Currency || !quote.Amount.Equal(amount) {
+			return ErrQuoteMismatch
+		}
+		if time.Now().After(quote.Expiry) {
+			return ErrQuoteExpired
+		}
+		rate = quote.Rate
+		destAmount = amount.Mul(rate)
+		quoteID = quote.ID
+
+		if err := s.ensureSuspenseAccounts(ctx, fromAccount.Currency, toAccount.Currency); err != nil {
+			return err
+		}
+		// Route the conversion through per-currency suspense accounts so
+		// each leg of the transaction sums to zero in its own currency.
+		postings = append(postings,
+			Posting{AccountID: fromAccount.ID, Currency: fromAccount.Currency, Amount: sourceAmount.Neg()},
+			Posting{AccountID: suspenseAccountID(fromAccount.Currency), Currency: fromAccount.Currency, Amount: sourceAmount},
+			Posting{AccountID: suspenseAccountID(toAccount.Currency), Currency: toAccount.Currency, Amount: destAmount.Neg()},
+			Posting{AccountID: toAccount.ID, Currency: toAccount.Currency, Amount: destAmount},
+		)
+	}
+
+	// Post the ledger transaction and record the payment in the same
+	// SERIALIZABLE transaction, retried with backoff, so a failure to
+	// insert the payments row rolls back the postings too rather than
+	// leaving an unrecorded transfer (see reversePaymentTx for the same
+	// pattern).
+	return withSerializableRetry(ctx, s.db, s.maxTxRetries, func(tx pgx.Tx) error {
+		txnID, err := postTransactionTx(ctx, tx, postings, false)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO payments (from_account_id, to_account_id, amount, source_amount, dest_amount, rate, quote_id, transaction_id)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)`,
+			fromAccount.ID, toAccount.ID, amount, sourceAmount, destAmount, rate, quoteID, txnID)
 		return err
+	})
+}
+
+// ReloadRules refreshes the cached rule set from the rules table.
+func (s *service) ReloadRules(ctx context.Context) error {
+	return s.rules.Load(ctx)
+}
+
+// ensureSuspenseAccounts creates the FX suspense accounts for the given
+// currencies if they do not already exist.
+func (s *service) ensureSuspenseAccounts(ctx context.Context, currencies ...string) error {
+	for _, currency := range currencies {
+		_, err := s.db.Exec(ctx, `
+			INSERT INTO accounts (id, currency, allow_negative) VALUES ($1, $2, true)
+			ON CONFLICT (id) DO NOTHING`,
+			suspenseAccountID(currency), currency)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -234,10 +416,50 @@ func (mw loggingMiddleware) ListPayments(ctx context.Context) (payments []*Payme
 	return
 }
 
-func (mw loggingMiddleware) SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal) (err error) {
+func (mw loggingMiddleware) GetQuote(ctx context.Context, from, to string, amount decimal.Decimal) (quote *Quote, err error) {
+	defer func() {
+		mw.logger.Log("method", "GetQuote", "from", from, "to", to, "amount", amount, "err", err)
+	}()
+	quote, err = mw.next.GetQuote(ctx, from, to, amount)
+	return
+}
+
+func (mw loggingMiddleware) SendPayment(ctx context.Context, fromAccountID, toAccountID string, amount decimal.Decimal, quoteToken, idempotencyKey string) (err error) {
 	defer func() {
 		mw.logger.Log("method", "SendPayment", "fromAccountID", fromAccountID, "toAccountID", toAccountID, "amount", amount, "err", err)
 	}()
-	err = mw.next.SendPayment(ctx, fromAccountID, toAccountID, amount)
+	err = mw.next.SendPayment(ctx, fromAccountID, toAccountID, amount, quoteToken, idempotencyKey)
+	return
+}
+
+func (mw loggingMiddleware) ReversePayment(ctx context.Context, paymentID int, reason string) (payment *Payment, err error) {
+	defer func() {
+		mw.logger.Log("method", "ReversePayment", "paymentID", paymentID, "reason", reason, "err", err)
+	}()
+	payment, err = mw.next.ReversePayment(ctx, paymentID, reason)
+	return
+}
+
+func (mw loggingMiddleware) PostTransaction(ctx context.Context, postings []Posting) (txnID string, err error) {
+	defer func() {
+		mw.logger.Log("method", "PostTransaction", "postings", len(postings), "transactionID", txnID, "err", err)
+	}()
+	txnID, err = mw.next.PostTransaction(ctx, postings)
+	return
+}
+
+func (mw loggingMiddleware) GetBalance(ctx context.Context, accountID string, at time.Time) (balance decimal.Decimal, err error) {
+	defer func() {
+		mw.logger.Log("method", "GetBalance", "accountID", accountID, "at", at, "err", err)
+	}()
+	balance, err = mw.next.GetBalance(ctx, accountID, at)
+	return
+}
+
+func (mw loggingMiddleware) ReloadRules(ctx context.Context) (err error) {
+	defer func() {
+		mw.logger.Log("method", "ReloadRules", "err", err)
+	}()
+	err = mw.next.ReloadRules(ctx)
 	return
 }
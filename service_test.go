@@ -2,18 +2,28 @@ package wallet
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/shopspring/decimal"
 )
 
+func newTestService(dbpool *pgxpool.Pool) Service {
+	rates := NewStaticRateProvider(map[string]decimal.Decimal{
+		"USD:EUR": decimal.RequireFromString("0.9"),
+	})
+	return NewWalletService(dbpool, rates, []byte("test-signing-key"), NewRuleEngine(dbpool), 0)
+}
+
 func TestListAccounts(t *testing.T) {
 	dbpool, err := InitDB()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer dbpool.Close()
-	svc := NewWalletService(dbpool)
+	svc := newTestService(dbpool)
 
 	accounts, err := svc.ListAccounts(context.Background())
 	if err != nil {
@@ -30,7 +40,7 @@ func TestListPayments(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer dbpool.Close()
-	svc := NewWalletService(dbpool)
+	svc := newTestService(dbpool)
 	ctx := context.Background()
 
 	payments, err := svc.ListPayments(ctx)
@@ -41,11 +51,11 @@ func TestListPayments(t *testing.T) {
 		t.Fatal("wrong number of payments")
 	}
 
-	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10))
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.RequireFromString("0.5"))
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.RequireFromString("0.5"), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,50 +84,316 @@ func TestSendPayment(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer dbpool.Close()
-	svc := NewWalletService(dbpool)
+	svc := newTestService(dbpool)
 	ctx := context.Background()
 
 	// Bad IDs
-	err = svc.SendPayment(ctx, "", "", decimal.NewFromInt(1))
+	err = svc.SendPayment(ctx, "", "", decimal.NewFromInt(1), "", "")
 	if err != ErrAccountNotSpecified {
 		t.Errorf("%v instead of ErrAccountNotSpecified", err)
 	}
-	err = svc.SendPayment(ctx, "testid", "", decimal.NewFromInt(1))
+	err = svc.SendPayment(ctx, "testid", "", decimal.NewFromInt(1), "", "")
 	if err != ErrAccountNotSpecified {
 		t.Errorf("%v instead of ErrAccountNotSpecified", err)
 	}
-	err = svc.SendPayment(ctx, "testid", "testid", decimal.NewFromInt(1))
+	err = svc.SendPayment(ctx, "testid", "testid", decimal.NewFromInt(1), "", "")
 	if err != ErrSameAccount {
 		t.Errorf("%v instead of ErrSameAccount", err)
 	}
 
 	// Bad amount
-	err = svc.SendPayment(ctx, "testid1", "testid2", decimal.NewFromInt(-1))
+	err = svc.SendPayment(ctx, "testid1", "testid2", decimal.NewFromInt(-1), "", "")
 	if err != ErrInvalidAmount {
 		t.Errorf("%v instead of ErrInvalidAmount", err)
 	}
 
 	// Non-existing accounts
-	err = svc.SendPayment(ctx, "testid1", "testid2", decimal.NewFromInt(1))
+	err = svc.SendPayment(ctx, "testid1", "testid2", decimal.NewFromInt(1), "", "")
 	if err != ErrAccountNotFound {
 		t.Errorf("%v instead of ErrAccountNotFound", err)
 	}
 
-	// Different currencies
-	err = svc.SendPayment(ctx, "alice456", "eve789", decimal.NewFromInt(1))
-	if err != ErrCurrencyMismatch {
-		t.Errorf("%v instead of ErrCurrencyMismatch", err)
+	// Different currencies without a quote
+	err = svc.SendPayment(ctx, "alice456", "eve789", decimal.NewFromInt(1), "", "")
+	if err != ErrQuoteRequired {
+		t.Errorf("%v instead of ErrQuoteRequired", err)
 	}
 
 	// Not enough money
-	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100))
+	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100), "", "")
 	if err != ErrInsufficientBalance {
 		t.Errorf("%v instead of ErrInsufficientBalance", err)
 	}
 
 	// OK
-	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10))
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetQuoteAndCrossCurrencyPayment(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	quote, err := svc.GetQuote(ctx, "USD", "EUR", decimal.NewFromInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Token() == "" {
+		t.Fatal("quote has no token")
+	}
+
+	err = svc.SendPayment(ctx, "bob123", "eve789", decimal.NewFromInt(10), quote.Token(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tampered token is rejected.
+	err = svc.SendPayment(ctx, "bob123", "eve789", decimal.NewFromInt(10), quote.Token()+"x", "")
+	if err != ErrQuoteInvalid {
+		t.Errorf("%v instead of ErrQuoteInvalid", err)
+	}
+}
+
+func TestSendPaymentIdempotency(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	existing, err := svc.ListPayments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10), "", "send-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry with the same key and the same request replays the result
+	// instead of sending the payment again.
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10), "", "send-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := svc.ListPayments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != len(existing)+1 {
+		t.Fatal("payment was sent more than once")
+	}
+
+	// Reusing the key with a different request is rejected.
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(20), "", "send-1")
+	if err != ErrIdempotencyKeyReuse {
+		t.Errorf("%v instead of ErrIdempotencyKeyReuse", err)
+	}
+}
+
+func TestSendPaymentIdempotencyReplaysTypedFailure(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100), "", "send-fail-1")
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("%v instead of ErrInsufficientBalance", err)
+	}
+
+	// Retrying the same failed request must replay the original typed
+	// error, with its details, rather than a generic internal error.
+	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100), "", "send-fail-1")
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("%v instead of ErrInsufficientBalance", err)
+	}
+	var walletErr *Error
+	if !errors.As(err, &walletErr) {
+		t.Fatal("replayed error does not carry details")
+	}
+	if walletErr.Details["account_id"] != "alice456" {
+		t.Errorf("wrong account_id detail: %v", walletErr.Details["account_id"])
+	}
+}
+
+func TestReversePayment(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(10), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := svc.ListPayments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paymentID := payments[len(payments)-1].ID
+
+	before, err := svc.GetBalance(ctx, "bob123", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reversal, err := svc.ReversePayment(ctx, paymentID, "sent by mistake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversal.ReversesID == nil || *reversal.ReversesID != paymentID {
+		t.Error("reversal not linked to the original payment")
+	}
+
+	after, err := svc.GetBalance(ctx, "bob123", time.Time{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !after.Equal(before.Add(decimal.NewFromInt(10))) {
+		t.Error("balance not restored by reversal")
+	}
+
+	if _, err := svc.ReversePayment(ctx, paymentID, "again"); err != ErrPaymentAlreadyReversed {
+		t.Errorf("%v instead of ErrPaymentAlreadyReversed", err)
+	}
+}
+
+func TestSendPaymentErrorDetails(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100), "", "")
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("%v instead of ErrInsufficientBalance", err)
+	}
+	var walletErr *Error
+	if !errors.As(err, &walletErr) {
+		t.Fatal("error does not carry details")
+	}
+	if walletErr.Details["account_id"] != "alice456" {
+		t.Errorf("wrong account_id detail: %v", walletErr.Details["account_id"])
+	}
+	if _, ok := walletErr.Details["available"]; !ok {
+		t.Error("missing available detail")
+	}
+	if _, ok := walletErr.Details["required"]; !ok {
+		t.Error("missing required detail")
+	}
+}
+
+func TestRuleEngineCheck(t *testing.T) {
+	from := &Account{ID: "bob123", Currency: "USD", Balance: decimal.NewFromInt(100)}
+	to := &Account{ID: "alice456", Currency: "USD", Balance: decimal.NewFromInt(50)}
+
+	engine := &RuleEngine{}
+	engine.rules = []Rule{{Script: "deny('too large')"}}
+	err := engine.Check(from, to, decimal.NewFromInt(10))
+	if !errors.Is(err, ErrRuleDenied) {
+		t.Errorf("%v instead of ErrRuleDenied", err)
+	}
+
+	engine.rules = []Rule{{Script: "require_approval()"}}
+	err = engine.Check(from, to, decimal.NewFromInt(10))
+	if err != ErrApprovalRequired {
+		t.Errorf("%v instead of ErrApprovalRequired", err)
+	}
+
+	engine.rules = []Rule{{Script: "if tonumber(amount) > 1000 then deny('too large') else allow() end"}}
+	err = engine.Check(from, to, decimal.NewFromInt(10))
+	if err != nil {
+		t.Errorf("unexpected denial: %v", err)
+	}
+}
+
+func TestSendPaymentRuleSeesLiveBalance(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	rates := NewStaticRateProvider(map[string]decimal.Decimal{
+		"USD:EUR": decimal.RequireFromString("0.9"),
+	})
+	engine := &RuleEngine{}
+	engine.rules = []Rule{{Script: "if tonumber(from_account.balance) < tonumber(amount) then deny('insufficient for rule') end"}}
+	svc := NewWalletService(dbpool, rates, []byte("test-signing-key"), engine, 0)
+	ctx := context.Background()
+
+	// alice456 has a real balance too small to cover this transfer, so the
+	// rule must see it and deny rather than the always-zero placeholder.
+	err = svc.SendPayment(ctx, "alice456", "bob123", decimal.NewFromInt(100), "", "")
+	if !errors.Is(err, ErrRuleDenied) {
+		t.Fatalf("%v instead of ErrRuleDenied", err)
+	}
+
+	// bob123 has enough, so the same rule must allow it.
+	err = svc.SendPayment(ctx, "bob123", "alice456", decimal.NewFromInt(1), "", "")
+	if err != nil {
+		t.Fatalf("unexpected denial: %v", err)
+	}
+}
+
+func TestPostTransactionAndGetBalance(t *testing.T) {
+	dbpool, err := InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbpool.Close()
+	svc := newTestService(dbpool)
+	ctx := context.Background()
+
+	// Unbalanced postings are rejected.
+	_, err = svc.PostTransaction(ctx, []Posting{
+		{AccountID: "bob123", Currency: "USD", Amount: decimal.NewFromInt(-10)},
+		{AccountID: "alice456", Currency: "USD", Amount: decimal.NewFromInt(5)},
+	})
+	if err != ErrTransactionUnbalanced {
+		t.Errorf("%v instead of ErrTransactionUnbalanced", err)
+	}
+
+	before, err := svc.GetBalance(ctx, "bob123", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txnID, err := svc.PostTransaction(ctx, []Posting{
+		{AccountID: "bob123", Currency: "USD", Amount: decimal.NewFromInt(-10)},
+		{AccountID: "alice456", Currency: "USD", Amount: decimal.NewFromInt(10)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txnID == "" {
+		t.Fatal("empty transaction id")
+	}
+
+	after, err := svc.GetBalance(ctx, "bob123", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Equal(before.Sub(decimal.NewFromInt(10))) {
+		t.Error("balance not updated by posted transaction")
+	}
 }
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 
@@ -26,9 +28,12 @@ func MakeHTTPHandler(svc Service, logger log.Logger) http.Handler {
 		httptransport.ServerErrorEncoder(encodeError),
 	}
 
-	// GET   /accounts  list accounts
-	// GET   /payments  list payments
-	// POST  /payments  send a payment
+	// GET   /accounts          list accounts
+	// GET   /payments          list payments
+	// POST  /payments          send a payment
+	// POST  /payments/{id}/reverse  reverse a previously sent payment
+	// POST  /quote             get a quote to convert between currencies
+	// POST  /rules             hot-reload the payment validation rules
 
 	r.Methods("GET").Path("/accounts").Handler(httptransport.NewServer(
 		makeListAccountsEndpoint(svc),
@@ -48,6 +53,24 @@ func MakeHTTPHandler(svc Service, logger log.Logger) http.Handler {
 		encodeResponse,
 		options...,
 	))
+	r.Methods("POST").Path("/payments/{id}/reverse").Handler(httptransport.NewServer(
+		makeReversePaymentEndpoint(svc),
+		decodeReversePaymentRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/quote").Handler(httptransport.NewServer(
+		makeGetQuoteEndpoint(svc),
+		decodeGetQuoteRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/rules").Handler(httptransport.NewServer(
+		makeReloadRulesEndpoint(svc),
+		decodeReloadRulesRequest,
+		encodeResponse,
+		options...,
+	))
 	return r
 }
 
@@ -66,6 +89,37 @@ func decodeSendPaymentRequest(_ context.Context, r *http.Request) (interface{},
 	if e := dec.Decode(&req); e != nil {
 		return nil, ErrMalformedJSON
 	}
+	req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	return req, nil
+}
+
+func decodeReversePaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, ErrMalformedJSON
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if e := dec.Decode(&body); e != nil && e != io.EOF {
+		return nil, ErrMalformedJSON
+	}
+	return reversePaymentRequest{PaymentID: id, Reason: body.Reason}, nil
+}
+
+func decodeReloadRulesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return reloadRulesRequest{}, nil
+}
+
+func decodeGetQuoteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req getQuoteRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if e := dec.Decode(&req); e != nil {
+		return nil, ErrMalformedJSON
+	}
 	return req, nil
 }
 
@@ -83,30 +137,94 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 	return json.NewEncoder(w).Encode(response)
 }
 
+// problemDetails is an RFC 7807-style problem+json response body. Code is a
+// stable, machine-readable identifier clients can switch on; Details carries
+// error-specific context (e.g. the accounts and amounts involved).
+type problemDetails struct {
+	Code    string                 `json:"code"`
+	Status  int                    `json:"status"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// errorEntry associates a sentinel error with the machine code and HTTP
+// status reported for it and any error wrapping it.
+type errorEntry struct {
+	err    error
+	code   string
+	status int
+}
+
+// errorRegistry is consulted in order, so more specific errors must precede
+// more general ones they would otherwise also match via errors.Is.
+var errorRegistry = []errorEntry{
+	{ErrCurrencyMismatch, "WALLET.CURRENCY_MISMATCH", http.StatusForbidden},
+	{ErrInsufficientBalance, "WALLET.INSUFFICIENT_BALANCE", http.StatusForbidden},
+	{ErrInvalidAmount, "WALLET.INVALID_AMOUNT", http.StatusForbidden},
+	{ErrSameAccount, "WALLET.SAME_ACCOUNT", http.StatusForbidden},
+	{ErrAccountNotFound, "WALLET.ACCOUNT_NOT_FOUND", http.StatusNotFound},
+	{ErrMalformedJSON, "WALLET.MALFORMED_JSON", http.StatusBadRequest},
+	{ErrAccountNotSpecified, "WALLET.ACCOUNT_NOT_SPECIFIED", http.StatusBadRequest},
+	{ErrQuoteRequired, "WALLET.QUOTE_REQUIRED", http.StatusBadRequest},
+	{ErrQuoteMismatch, "WALLET.QUOTE_MISMATCH", http.StatusBadRequest},
+	{ErrTransactionUnbalanced, "WALLET.TRANSACTION_UNBALANCED", http.StatusBadRequest},
+	{ErrTransactionTooShort, "WALLET.TRANSACTION_TOO_SHORT", http.StatusBadRequest},
+	{ErrQuoteExpired, "WALLET.QUOTE_EXPIRED", http.StatusGone},
+	{ErrQuoteInvalid, "WALLET.QUOTE_INVALID", http.StatusGone},
+	{ErrRateUnavailable, "WALLET.RATE_UNAVAILABLE", http.StatusServiceUnavailable},
+	{ErrRuleDenied, "WALLET.RULE_DENIED", http.StatusForbidden},
+	{ErrApprovalRequired, "WALLET.APPROVAL_REQUIRED", http.StatusConflict},
+	{ErrIdempotencyInProgress, "WALLET.IDEMPOTENCY_IN_PROGRESS", http.StatusConflict},
+	{ErrIdempotencyIndeterminate, "WALLET.IDEMPOTENCY_INDETERMINATE", http.StatusConflict},
+	{ErrIdempotencyKeyReuse, "WALLET.IDEMPOTENCY_KEY_REUSE", http.StatusUnprocessableEntity},
+	{ErrPaymentAlreadyReversed, "WALLET.PAYMENT_ALREADY_REVERSED", http.StatusConflict},
+	{ErrPaymentNotFound, "WALLET.PAYMENT_NOT_FOUND", http.StatusNotFound},
+}
+
+// codeFrom looks up the machine code and HTTP status registered for err,
+// falling back to a generic internal-error entry for anything unrecognized.
+func codeFrom(err error) (code string, status int) {
+	for _, e := range errorRegistry {
+		if errors.Is(err, e.err) {
+			return e.code, e.status
+		}
+	}
+	return "WALLET.INTERNAL", http.StatusInternalServerError
+}
+
+// errorFromCode looks up the sentinel error registered under code, for
+// reconstructing an error from a machine code stored outside the process
+// (e.g. an idempotency replay). It returns nil if code is unrecognized.
+func errorFromCode(code string) error {
+	for _, e := range errorRegistry {
+		if e.code == code {
+			return e.err
+		}
+	}
+	return nil
+}
+
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	code := codeFrom(err)
+	code, status := codeFrom(err)
 	msg := err.Error()
-	if code == http.StatusInternalServerError {
+	var details map[string]interface{}
+	var walletErr *Error
+	if errors.As(err, &walletErr) {
+		details = walletErr.Details
+	}
+	if status == http.StatusInternalServerError {
 		msg = "internal server error"
+		details = nil
 	}
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": msg,
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problemDetails{
+		Code:    code,
+		Status:  status,
+		Message: msg,
+		Details: details,
 	})
 }
-
-func codeFrom(err error) int {
-	switch err {
-	case ErrCurrencyMismatch, ErrInsufficientBalance, ErrInvalidAmount, ErrSameAccount:
-		return http.StatusForbidden
-	case ErrAccountNotFound:
-		return http.StatusNotFound
-	case ErrMalformedJSON, ErrAccountNotSpecified:
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
-	}
-}